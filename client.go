@@ -0,0 +1,410 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+	"golang.org/x/mod/module"
+)
+
+// errNoUpstream is returned by proxyClient.get when no upstream proxy is
+// configured, or the chain reaches a "direct" terminator, so callers know
+// to fall back to resolver.
+var errNoUpstream = errors.New("goproxy: no upstream proxy configured")
+
+// errProxyOff is returned by proxyClient.get when the chain reaches an
+// "off" terminator: the request fails outright, with no resolver fallback.
+var errProxyOff = errors.New("goproxy: proxy disabled (GOPROXY=off)")
+
+// A moduleResolver resolves module metadata and content when no upstream
+// module proxy is configured, e.g. by talking to the module's VCS
+// directly. goCommandResolver, which shells out to the local go command,
+// is the only implementation today, but the interface keeps that choice
+// out of proxyClient so other resolution strategies can be plugged in later.
+type moduleResolver interface {
+	// List returns the raw "go list -m -versions" style version listing for mpath.
+	List(mpath string) ([]byte, error)
+	// Latest resolves the latest version of mpath and downloads it.
+	Latest(mpath string) (*downloadInfo, error)
+	// Download resolves and downloads the module version m.
+	Download(m module.Version) (*downloadInfo, error)
+}
+
+// goCommandResolver implements moduleResolver by shelling out to the local
+// go command, exactly as onlineOps did before proxyClient existed.
+type goCommandResolver struct{}
+
+// List runs "go list -m -json -versions" for mpath.
+func (goCommandResolver) List(mpath string) ([]byte, error) {
+	var list struct {
+		Path     string
+		Versions []string
+	}
+	if err := goJSON(&list, "go", "list", "-m", "-json", "-versions", mpath+"@latest"); err != nil {
+		return nil, err
+	}
+	if list.Path != mpath {
+		return nil, fmt.Errorf("go list -m: asked for %s but got %s", mpath, list.Path)
+	}
+	data := []byte(strings.Join(list.Versions, "\n") + "\n")
+	if len(data) == 1 {
+		data = nil
+	}
+	return data, nil
+}
+
+// Latest runs "go mod download -json" for mpath@latest.
+func (goCommandResolver) Latest(mpath string) (*downloadInfo, error) {
+	return goCommandResolver{}.Download(module.Version{Path: mpath, Version: "latest"})
+}
+
+// Download runs "go mod download -json" for m.
+func (goCommandResolver) Download(m module.Version) (*downloadInfo, error) {
+	d := new(downloadInfo)
+	return d, goJSON(d, "go", "mod", "download", "-json", m.String())
+}
+
+// An upstream is one entry of a GOPROXY-style fallback chain: either a
+// proxy URL, or one of the two chain terminators, "direct" and "off".
+type upstream struct {
+	url string
+	// fallbackOnAnyError reports whether a failed request against this
+	// upstream should fall through to the next one unconditionally (a ','
+	// separator) or only on a 404/410 "not found" response (a '|'
+	// separator), matching the go command's GOPROXY chain semantics.
+	fallbackOnAnyError bool
+	// direct marks this entry as the "direct" terminator: stop trying
+	// proxies and resolve the module directly against its VCS instead.
+	direct bool
+	// off marks this entry as the "off" terminator: stop and fail the
+	// request outright, without ever falling back to direct resolution.
+	off bool
+}
+
+// A proxyClient is a first-class Go module proxy client: it speaks the
+// module proxy protocol (the five @latest, @v/list, @v/<ver>.info, .mod
+// and .zip endpoints) directly to one or more upstream proxies instead of
+// shelling out to the go command for every request. When no upstream is
+// configured, or every configured upstream has been exhausted, it falls
+// back to resolver.
+type proxyClient struct {
+	upstreams []upstream
+	resolver  moduleResolver
+	http      *http.Client
+	// checkDeprecations enables logDeprecation on this client's List
+	// refreshes. It's only set on the process-wide default/direct clients
+	// (see main.go), never on a -policy rule's private Upstream client:
+	// logDeprecation always resolves mpath directly against its VCS,
+	// bypassing whatever upstream a policy rule chose, so running it for a
+	// privately-routed module would leak an unwanted direct-VCS attempt for
+	// every refresh.
+	checkDeprecations bool
+}
+
+// newProxyClient builds a proxyClient for the given GOPROXY-style chain
+// (entries separated by ',' or '|'). "direct" and "off" are kept as real
+// chain entries, not dropped: reaching "direct" stops the chain and
+// resolves the module directly against its VCS, and reaching "off" stops
+// the chain and fails the request outright, exactly like the go command's
+// own GOPROXY handling. An empty chain yields a client that always falls
+// back to resolver, as if the chain were just "direct".
+func newProxyClient(chain string, resolver moduleResolver) *proxyClient {
+	c := &proxyClient{
+		resolver: resolver,
+		http:     &http.Client{Timeout: 2 * time.Minute},
+	}
+	for chain != "" {
+		var entry string
+		sep := byte(',')
+		if i := strings.IndexAny(chain, ",|"); i >= 0 {
+			sep, entry, chain = chain[i], chain[:i], chain[i+1:]
+		} else {
+			entry, chain = chain, ""
+		}
+		entry = strings.TrimSpace(entry)
+		switch entry {
+		case "":
+			continue
+		case "direct":
+			c.upstreams = append(c.upstreams, upstream{direct: true})
+		case "off":
+			c.upstreams = append(c.upstreams, upstream{off: true})
+		default:
+			c.upstreams = append(c.upstreams, upstream{
+				url:                strings.TrimSuffix(entry, "/"),
+				fallbackOnAnyError: sep == ',',
+			})
+		}
+	}
+	return c
+}
+
+// notFoundError records a 404 or 410 response from an upstream proxy.
+type notFoundError struct {
+	url    string
+	status int
+	body   string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.url, e.status, e.body)
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// get fetches rel (e.g. "@v/list" or "@v/v1.2.3.info") relative to mpath
+// from the upstream chain, honoring the 410/404-falls-through-to-next and
+// any-error-falls-through-to-next chain semantics. It returns
+// errNoUpstream if no upstream is configured, or the chain falls through
+// to a "direct" terminator, and errProxyOff if it falls through to "off".
+func (c *proxyClient) get(ctx context.Context, mpath, rel string) ([]byte, error) {
+	if len(c.upstreams) == 0 {
+		return nil, errNoUpstream
+	}
+	escMod, err := module.EscapePath(mpath)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error = errNoUpstream
+	for _, up := range c.upstreams {
+		if up.direct {
+			return nil, errNoUpstream
+		}
+		if up.off {
+			return nil, errProxyOff
+		}
+		u := up.url + "/" + escMod + "/" + rel
+		data, err := c.getOnce(ctx, u)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if !up.fallbackOnAnyError && !isNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *proxyClient) getOnce(ctx context.Context, rawurl string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if noFetch {
+		req.Header.Set("Disable-Module-Fetch", "true")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<30))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, &notFoundError{url: rawurl, status: resp.StatusCode, body: strings.TrimSpace(string(body))}
+	default:
+		return nil, fmt.Errorf("%s: %s: %s", rawurl, resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// putCache writes data to store under key.
+func putCache(ctx context.Context, key string, data []byte) error {
+	return store.Put(ctx, key, bytes.NewReader(data))
+}
+
+// storageFile fetches key from store and adapts it to a proxy.File,
+// which proxy.Server needs to both Stat and Seek within.
+func storageFile(ctx context.Context, key string) (proxy.File, error) {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.MemFile(data, info.ModTime), nil
+}
+
+// adoptResolverFile reads a file resolved locally (by goCommandResolver,
+// from its own GOPATH) and stores it under key in store, so a remote
+// Storage backend sees modules resolved directly via VCS too, not just
+// the ones fetched from an upstream proxy.
+func adoptResolverFile(ctx context.Context, key, localFile string) (proxy.File, error) {
+	data, err := ioutil.ReadFile(localFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := putCache(ctx, key, data); err != nil {
+		return nil, err
+	}
+	return proxy.MemFile(data, time.Now()), nil
+}
+
+// List returns the cached version list for mpath, refreshing it from the
+// upstream chain (or resolver, in direct mode) once the cache entry has
+// expired. ttl overrides the default listExpire freshness window when
+// positive, e.g. to honor a per-module -policy TTL override.
+func (c *proxyClient) List(ctx context.Context, mpath string, ttl time.Duration) (proxy.File, error) {
+	if ttl <= 0 {
+		ttl = listExpire
+	}
+	escMod, err := module.EscapePath(mpath)
+	if err != nil {
+		return nil, err
+	}
+	key := path.Join(escMod, "@v", "list")
+	if info, err := store.Stat(ctx, key); err == nil && time.Since(info.ModTime) < ttl {
+		return storageFile(ctx, key)
+	}
+	if err := checkNotFoundCache(ctx, key); err != nil {
+		return nil, err
+	}
+	data, err := c.get(ctx, mpath, "@v/list")
+	if err == errNoUpstream {
+		data, err = c.resolver.List(mpath)
+	}
+	if isNotFound(err) {
+		recordNotFound(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Checked on every real refresh, not just the goCommandResolver
+	// fallback, so deprecation/retraction notices surface the same way
+	// whether mpath's versions came from an upstream proxy or direct VCS
+	// resolution - but only for c.checkDeprecations clients (see its doc
+	// comment), and off the request path, since it shells out to the go
+	// command.
+	if c.checkDeprecations {
+		go logDeprecation(mpath)
+	}
+	if err := putCache(ctx, key, data); err != nil {
+		return nil, err
+	}
+	return storageFile(ctx, key)
+}
+
+// Latest returns an info file for the latest known version of mpath. This
+// is the path "go get m"/"go get m@latest" hits for any untagged module,
+// so it shares the same negative cache List and versionFile use: without
+// it, repeated lookups of a nonexistent or untagged module would stampede
+// the upstream on every request.
+func (c *proxyClient) Latest(ctx context.Context, mpath string) (proxy.File, error) {
+	escMod, err := module.EscapePath(mpath)
+	if err != nil {
+		return nil, err
+	}
+	key := path.Join(escMod, "@latest.info")
+	if err := checkNotFoundCache(ctx, key); err != nil {
+		return nil, err
+	}
+	data, err := c.get(ctx, mpath, "@latest")
+	if err == errNoUpstream {
+		d, derr := c.resolver.Latest(mpath)
+		if derr != nil {
+			return nil, derr
+		}
+		return adoptResolverFile(ctx, path.Join(mpath, "@latest.info"), d.Info)
+	}
+	if isNotFound(err) {
+		recordNotFound(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proxy.MemFile(data, time.Now()), nil
+}
+
+// Info returns the cached .info file for m, fetching and caching it from
+// the upstream chain (or resolver, in direct mode) if necessary.
+func (c *proxyClient) Info(ctx context.Context, m module.Version) (proxy.File, error) {
+	return c.versionFile(ctx, m, ".info")
+}
+
+// GoMod returns the cached .mod file for m.
+func (c *proxyClient) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
+	return c.versionFile(ctx, m, ".mod")
+}
+
+// Zip returns the cached .zip file for m.
+func (c *proxyClient) Zip(ctx context.Context, m module.Version) (proxy.File, error) {
+	return c.versionFile(ctx, m, ".zip")
+}
+
+func (c *proxyClient) versionFile(ctx context.Context, m module.Version, suffix string) (proxy.File, error) {
+	escMod, err := module.EscapePath(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	escVers, err := module.EscapeVersion(m.Version)
+	if err != nil {
+		return nil, err
+	}
+	key := path.Join(escMod, "@v", escVers+suffix)
+	name := strings.TrimPrefix(suffix, ".")
+	if _, err := store.Stat(ctx, key); err == nil && verifyCached(ctx, m.Path, m.Version, name, key) == nil {
+		return storageFile(ctx, key)
+	}
+	if err := checkNotFoundCache(ctx, key); err != nil {
+		return nil, err
+	}
+	data, err := c.get(ctx, m.Path, "@v/"+escVers+suffix)
+	if err == errNoUpstream {
+		d, derr := c.resolver.Download(m)
+		if derr != nil {
+			return nil, derr
+		}
+		switch suffix {
+		case ".info":
+			return adoptResolverFile(ctx, key, d.Info)
+		case ".mod":
+			return adoptResolverFile(ctx, key, d.GoMod)
+		case ".zip":
+			return adoptResolverFile(ctx, key, d.Zip)
+		}
+	}
+	if isNotFound(err) {
+		recordNotFound(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := putCache(ctx, key, data); err != nil {
+		return nil, err
+	}
+	if verifyMode() != "off" {
+		if err := recordHash(ctx, m.Path, m.Version, name, key); err != nil {
+			log.Printf("goproxy: recording hash for %s failed: %v", key, err)
+		}
+	}
+	return storageFile(ctx, key)
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func notFoundServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func errorServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNewProxyClientDirectTerminator(t *testing.T) {
+	notFound := notFoundServer(t)
+
+	// "proxy,direct": a 404 from the proxy falls through to direct.
+	c := newProxyClient(notFound.URL+",direct", goCommandResolver{})
+	if len(c.upstreams) != 2 {
+		t.Fatalf("upstreams = %d, want 2", len(c.upstreams))
+	}
+	if !c.upstreams[1].direct {
+		t.Fatalf("upstreams[1].direct = false, want true")
+	}
+	_, err := c.get(context.Background(), "example.com/mod", "@v/list")
+	if err != errNoUpstream {
+		t.Errorf("get() after exhausting chain ending in direct = %v, want errNoUpstream", err)
+	}
+}
+
+func TestNewProxyClientOffTerminator(t *testing.T) {
+	notFound := notFoundServer(t)
+
+	c := newProxyClient(notFound.URL+",off", goCommandResolver{})
+	_, err := c.get(context.Background(), "example.com/mod", "@v/list")
+	if err != errProxyOff {
+		t.Errorf("get() after exhausting chain ending in off = %v, want errProxyOff", err)
+	}
+}
+
+func TestNewProxyClientPipeOnlyFallsThroughOnNotFound(t *testing.T) {
+	bad := errorServer(t)
+
+	// "proxy|direct": a hard (non-404) error must NOT fall through.
+	c := newProxyClient(bad.URL+"|direct", goCommandResolver{})
+	_, err := c.get(context.Background(), "example.com/mod", "@v/list")
+	if err == errNoUpstream || err == nil {
+		t.Errorf("get() with a hard error before a pipe separator = %v, want the hard error itself", err)
+	}
+}
+
+func TestNewProxyClientCommaFallsThroughOnAnyError(t *testing.T) {
+	bad := errorServer(t)
+
+	// "proxy,direct": any error, not just 404, falls through on a comma.
+	c := newProxyClient(bad.URL+",direct", goCommandResolver{})
+	_, err := c.get(context.Background(), "example.com/mod", "@v/list")
+	if err != errNoUpstream {
+		t.Errorf("get() with a hard error before a comma separator = %v, want errNoUpstream", err)
+	}
+}
+
+func TestNewProxyClientEmptyChainIsDirect(t *testing.T) {
+	c := newProxyClient("", goCommandResolver{})
+	if len(c.upstreams) != 0 {
+		t.Fatalf("upstreams = %d, want 0", len(c.upstreams))
+	}
+	_, err := c.get(context.Background(), "example.com/mod", "@v/list")
+	if err != errNoUpstream {
+		t.Errorf("get() with empty chain = %v, want errNoUpstream", err)
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -31,6 +30,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"testing"
 	"time"
 
 	"github.com/goproxyio/goproxy/v2/proxy"
@@ -48,6 +48,7 @@ var cacheDir string
 var proxyHost string
 var excludeHost string
 var offLine bool
+var noFetch bool
 
 func init() {
 	flag.StringVar(&excludeHost, "exclude", "", "exclude host pattern, you can exclude internal Git services")
@@ -55,7 +56,16 @@ func init() {
 	flag.StringVar(&cacheDir, "cacheDir", "", "Go Modules cache dir, default is $GOPATH/pkg/mod/cache/download")
 	flag.StringVar(&listen, "listen", "0.0.0.0:8081", "service listen address")
 	flag.BoolVar(&offLine, "offline", false, "Offline mode, use cache only")
-	flag.Parse()
+	flag.BoolVar(&noFetch, "noFetch", false, "send Disable-Module-Fetch: true to upstream proxies, failing instead of fetching modules missing from their cache")
+	// testing.Testing reports true inside a "go test" binary, where
+	// os.Args carries the test runner's own flags (-test.v and so on)
+	// instead of ours; parsing those here would fail every test run.
+	if !testing.Testing() {
+		flag.Parse()
+	}
+
+	initSumdbProxy()
+	initPolicy()
 
 	if os.Getenv("GIT_TERMINAL_PROMPT") == "" {
 		os.Setenv("GIT_TERMINAL_PROMPT", "0")
@@ -72,32 +82,61 @@ func init() {
 	// Enable Go module
 	os.Setenv("GO111MODULE", "on")
 	os.Setenv("GOPROXY", "direct")
-	os.Setenv("GOSUMDB", "off")
+	// Force GOSUMDB off for our own go command invocations (goCommandResolver,
+	// warmup's resolveBuildList, logDeprecation), regardless of -sumdb: this
+	// is about our own subprocess calls reaching the network, which is a
+	// separate concern from /sumdb/<name>/ proxying external clients, and
+	// that's already independently gated on sumdbProxy != nil in
+	// logger.ServeHTTP.
+	if os.Getenv("GOSUMDB") == "" {
+		os.Setenv("GOSUMDB", "off")
+	}
 
 	downloadRoot = getDownloadRoot()
+	var err error
+	store, err = newStorage(*storageFlag, downloadRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client = newProxyClient(proxyHost, goCommandResolver{})
+	client.checkDeprecations = true
+	directClient = newProxyClient("", goCommandResolver{})
+	directClient.checkDeprecations = true
 }
 
 func main() {
 	log.SetPrefix("goproxy.io: ")
 	log.SetFlags(0)
 
-	var handle http.Handler
+	if *warmupFlag != "" {
+		seeds, err := loadWarmupSeeds(*warmupFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("warmup: prefetching %d seed module(s) from %s\n", len(seeds), *warmupFlag)
+		go runWarmup(seeds)
+	}
+
 	if proxyHost != "" {
 		log.Printf("ProxyHost %s\n", proxyHost)
-		if excludeHost != "" {
-			log.Printf("ExcludeHost %s\n", excludeHost)
-		}
-		handle = &logger{proxy.NewRouter(proxy.NewServer(new(onlineOps)), &proxy.RouterOptions{
-			Pattern:      excludeHost,
-			Proxy:        proxyHost,
-			DownloadRoot: downloadRoot,
-		})}
+	}
+	if excludeHost != "" {
+		log.Printf("ExcludeHost %s\n", excludeHost)
+	}
+
+	// Every request is served by our own onlineOps/offlineOps, never by
+	// the embedded proxy.Router: Router reverse-proxies and caches to
+	// local disk entirely on its own, which would bypass checkPolicy,
+	// the configurable store, and hash verification for every request
+	// it considered "not excluded" - exactly the common case. -exclude
+	// is instead honored inside checkPolicy (see policy.go), using the
+	// same proxy.GlobsMatchPath the old Router used, so direct-vs-proxy
+	// routing, -policy ACLs, -storage and verify.go all share one path.
+	var handle http.Handler
+	if offLine {
+		handle = &logger{proxy.NewServer(new(offlineOps))}
 	} else {
-		if offLine {
-			handle = &logger{proxy.NewServer(new(offlineOps))}
-		} else {
-			handle = &logger{proxy.NewServer(new(onlineOps))}
-		}
+		handle = &logger{proxy.NewServer(new(onlineOps))}
 	}
 
 	server := &http.Server{Addr: listen, Handler: handle}
@@ -180,90 +219,100 @@ func (l *logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// sumdb proxying and caching, when -sumdb enables it, takes
+	// precedence over the module proxy's own (non-caching) sumdb handler.
+	if sumdbProxy != nil && strings.HasPrefix(r.URL.Path, "/sumdb/") {
+		start := time.Now()
+		rl := &responseLogger{code: 200, ResponseWriter: w}
+		sumdbProxy.ServeHTTP(rl, r)
+		log.Printf("%.3fs %d %s\n", time.Since(start).Seconds(), rl.code, r.URL)
+		return
+	}
+
+	// admin endpoint for triggering a warmup run without a restart
+	if r.URL.Path == "/warmup" {
+		start := time.Now()
+		rl := &responseLogger{code: 200, ResponseWriter: w}
+		warmupHandler{}.ServeHTTP(rl, r)
+		log.Printf("%.3fs %d %s\n", time.Since(start).Seconds(), rl.code, r.URL)
+		return
+	}
+
 	start := time.Now()
 	rl := &responseLogger{code: 200, ResponseWriter: w}
 	l.h.ServeHTTP(rl, r)
 	log.Printf("%.3fs %d %s\n", time.Since(start).Seconds(), rl.code, r.URL)
 }
 
-// An onlineOps is a proxy.ServerOps implementation.
+// An onlineOps is a proxy.ServerOps implementation. It answers requests
+// through client, a native module proxy protocol client, instead of
+// shelling out to the go command for every request.
 type onlineOps struct{}
 
-// NewContext creates a context.
+// client is the proxyClient shared by every onlineOps request. It is
+// built in init, once proxyHost has been parsed from the command line.
+var client *proxyClient
+
+// directClient is an upstream-less proxyClient, used by checkPolicy for
+// module paths matching -exclude, so they always go straight to their
+// VCS instead of the configured -proxy chain, exactly as -exclude did
+// when the embedded proxy.Router owned this decision.
+var directClient *proxyClient
+
+// NewContext returns r's own context, so canceling the HTTP request
+// actually cancels any upstream fetch made on its behalf, with r's bearer
+// token (if any) attached for checkPolicy to enforce -policy "auth" rules.
 func (*onlineOps) NewContext(r *http.Request) (context.Context, error) {
-	return context.Background(), nil
+	ctx := r.Context()
+	if tok := authTokenFromRequest(r); tok != "" {
+		ctx = context.WithValue(ctx, authTokenKey{}, tok)
+	}
+	return ctx, nil
 }
 
 // List lists proxy files.
 func (*onlineOps) List(ctx context.Context, mpath string) (proxy.File, error) {
-	escMod, err := module.EscapePath(mpath)
+	d, err := checkPolicy(ctx, mpath)
 	if err != nil {
 		return nil, err
 	}
-	file := filepath.Join(downloadRoot, escMod, "@v", "list")
-	if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) < listExpire {
-		return os.Open(file)
-	}
-	var list struct {
-		Path     string
-		Versions []string
-	}
-	if err := goJSON(&list, "go", "list", "-m", "-json", "-versions", mpath+"@latest"); err != nil {
-		return nil, err
-	}
-	if list.Path != mpath {
-		return nil, fmt.Errorf("go list -m: asked for %s but got %s", mpath, list.Path)
-	}
-	data := []byte(strings.Join(list.Versions, "\n") + "\n")
-	if len(data) == 1 {
-		data = nil
-	}
-	err = os.MkdirAll(path.Dir(file), os.ModePerm)
-	if err != nil {
-		log.Printf("make cache dir failed, err: %v.", err)
-		return nil, err
-	}
-	if err := ioutil.WriteFile(file, data, 0666); err != nil {
-		return nil, err
-	}
-
-	return os.Open(file)
+	return d.client.List(ctx, mpath, d.ttl)
 }
 
 // Latest fetches latest file.
-func (*onlineOps) Latest(ctx context.Context, path string) (proxy.File, error) {
-	d, err := download(module.Version{Path: path, Version: "latest"})
+func (*onlineOps) Latest(ctx context.Context, mpath string) (proxy.File, error) {
+	d, err := checkPolicy(ctx, mpath)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(d.Info)
+	return d.client.Latest(ctx, mpath)
 }
 
 // Info fetches info file.
 func (*onlineOps) Info(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := checkPolicy(ctx, m.Path)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(d.Info)
+	return d.client.Info(ctx, m)
 }
 
 // GoMod fetches go mod file.
 func (*onlineOps) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := checkPolicy(ctx, m.Path)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(d.GoMod)
+	return d.client.GoMod(ctx, m)
 }
 
 // Zip fetches zip file.
 func (*onlineOps) Zip(ctx context.Context, m module.Version) (proxy.File, error) {
-	d, err := download(m)
+	d, err := checkPolicy(ctx, m.Path)
 	if err != nil {
 		return nil, err
 	}
-	return os.Open(d.Zip)
+	return d.client.Zip(ctx, m)
 }
 
 type downloadInfo struct {
@@ -277,11 +326,6 @@ type downloadInfo struct {
 	GoModSum string
 }
 
-func download(m module.Version) (*downloadInfo, error) {
-	d := new(downloadInfo)
-	return d, goJSON(d, "go", "mod", "download", "-json", m.String())
-}
-
 // An offlineOps is a proxy.ServerOps implementation.
 type offlineOps struct{
 	onlineOps
@@ -289,47 +333,63 @@ type offlineOps struct{
 
 // List lists proxy files.
 func (*offlineOps) List(ctx context.Context, mpath string) (proxy.File, error) {
+	if _, err := checkPolicy(ctx, mpath); err != nil {
+		return nil, err
+	}
 	escMod, err := module.EscapePath(mpath)
 	if err != nil {
 		return nil, err
 	}
-	file := filepath.Join(downloadRoot, escMod, "@v", "list")
-	if _, err := os.Stat(file); err == nil {
-		return os.Open(file)
-	} else {
+	key := path.Join(escMod, "@v", "list")
+	if _, err := store.Stat(ctx, key); err != nil {
 		return nil, err
 	}
+	return storageFile(ctx, key)
 }
 
 // Latest fetches latest file.
-func (*offlineOps) Latest(ctx context.Context, path string) (proxy.File, error) {
-	return getOfflineFile(module.Version{Path: path, Version: "latest"}, ".info")
+func (*offlineOps) Latest(ctx context.Context, mpath string) (proxy.File, error) {
+	if _, err := checkPolicy(ctx, mpath); err != nil {
+		return nil, err
+	}
+	return getOfflineFile(ctx, module.Version{Path: mpath, Version: "latest"}, ".info")
 }
 
 // Info fetches info file.
 func (*offlineOps) Info(ctx context.Context, m module.Version) (proxy.File, error) {
-	return getOfflineFile(m, ".info")
+	if _, err := checkPolicy(ctx, m.Path); err != nil {
+		return nil, err
+	}
+	return getOfflineFile(ctx, m, ".info")
 }
 
 // GoMod fetches go mod file.
 func (*offlineOps) GoMod(ctx context.Context, m module.Version) (proxy.File, error) {
-	return getOfflineFile(m, ".mod")
+	if _, err := checkPolicy(ctx, m.Path); err != nil {
+		return nil, err
+	}
+	return getOfflineFile(ctx, m, ".mod")
 }
 
 // Zip fetches zip file.
 func (*offlineOps) Zip(ctx context.Context, m module.Version) (proxy.File, error) {
-	return getOfflineFile(m, ".zip")
+	if _, err := checkPolicy(ctx, m.Path); err != nil {
+		return nil, err
+	}
+	return getOfflineFile(ctx, m, ".zip")
 }
 
-func getOfflineFile(m module.Version, suffix string) (proxy.File, error) {
+func getOfflineFile(ctx context.Context, m module.Version, suffix string) (proxy.File, error) {
 	escMod, err := module.EscapePath(m.Path)
 	if err != nil {
 		return nil, err
 	}
-	file := filepath.Join(downloadRoot, escMod, "@v", m.Version+suffix)
-	if _, err := os.Stat(file); err == nil {
-		return os.Open(file)
-	} else {
+	key := path.Join(escMod, "@v", m.Version+suffix)
+	if _, err := store.Stat(ctx, key); err != nil {
+		return nil, err
+	}
+	if err := verifyCached(ctx, m.Path, m.Version, strings.TrimPrefix(suffix, "."), key); err != nil {
 		return nil, err
 	}
+	return storageFile(ctx, key)
 }
@@ -0,0 +1,231 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+// policyFlag names a YAML or JSON file that generalizes -exclude into
+// per-module-path-prefix routing: which upstream chain a module fetches
+// through, whether it's allowed, denied, or requires auth, and an optional
+// cache TTL override. Empty (the default) disables policy routing
+// entirely; every module then goes through the single -proxy chain, as
+// before this flag existed.
+var policyFlag = flag.String("policy", "", "path to a YAML or JSON ACL and per-module upstream routing policy file")
+
+// A policyRule matches every module path having Prefix as a path-segment
+// prefix. Upstream, when set, names a GOPROXY-style fallback chain (parsed
+// exactly like -proxy) to fetch matching modules through, instead of the
+// default -proxy chain; this is how an org routes e.g. "corp.example.com/"
+// to a private Athens or JFrog instance while everything else still goes
+// to the public proxy.
+type policyRule struct {
+	Prefix    string        `json:"prefix" yaml:"prefix"`
+	Upstream  string        `json:"upstream" yaml:"upstream"`
+	Action    string        `json:"action" yaml:"action"` // "allow" (default), "deny", or "auth"
+	AuthToken string        `json:"authToken" yaml:"authToken"`
+	TTL       time.Duration `json:"ttl" yaml:"ttl"`
+}
+
+// A policy is the parsed, ready-to-use form of -policy: its rules, plus
+// one proxyClient per distinct Upstream, built once at load time so a
+// lookup never has to parse a GOPROXY chain on the request path.
+type policy struct {
+	rules     []policyRule
+	upstreams map[string]*proxyClient
+}
+
+// policyDecision is what policy.resolve returns for a single module path.
+type policyDecision struct {
+	client    *proxyClient
+	action    string
+	authToken string
+	ttl       time.Duration
+}
+
+// activePolicy holds the current policy, swapped out wholesale on reload
+// so in-flight lookups never observe a half-applied update. A nil value
+// (the default, when -policy is unset) allows every module path through
+// the default -proxy chain.
+var activePolicy struct {
+	mu sync.RWMutex
+	p  *policy
+}
+
+func currentPolicy() *policy {
+	activePolicy.mu.RLock()
+	defer activePolicy.mu.RUnlock()
+	return activePolicy.p
+}
+
+// initPolicy loads -policy, if set, and arms a SIGHUP handler that
+// reloads it without restarting the process - the same mechanism admins
+// already use to reload nginx or sshd config. It is called from main.go's
+// init, after flag.Parse.
+func initPolicy() {
+	if *policyFlag == "" {
+		return
+	}
+	if err := reloadPolicy(); err != nil {
+		log.Fatalf("goproxy: loading -policy %s: %v", *policyFlag, err)
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := reloadPolicy(); err != nil {
+				log.Printf("goproxy: reloading -policy %s failed, keeping previous policy: %v", *policyFlag, err)
+				continue
+			}
+			log.Printf("goproxy: reloaded -policy %s", *policyFlag)
+		}
+	}()
+}
+
+func reloadPolicy() error {
+	p, err := loadPolicy(*policyFlag)
+	if err != nil {
+		return err
+	}
+	activePolicy.mu.Lock()
+	activePolicy.p = p
+	activePolicy.mu.Unlock()
+	return nil
+}
+
+// loadPolicy parses file as YAML, or JSON when its extension is ".json",
+// into a policy, pre-building one proxyClient per distinct Upstream chain
+// named by its rules.
+func loadPolicy(file string) (*policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []policyRule
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		err = json.Unmarshal(data, &rules)
+	} else {
+		err = yaml.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{rules: rules, upstreams: make(map[string]*proxyClient)}
+	for _, r := range rules {
+		if r.Upstream == "" {
+			continue
+		}
+		if _, ok := p.upstreams[r.Upstream]; !ok {
+			p.upstreams[r.Upstream] = newProxyClient(r.Upstream, goCommandResolver{})
+		}
+	}
+	return p, nil
+}
+
+// resolve returns mpath's policyDecision: the rule with the longest
+// matching Prefix wins. No matching rule (or a nil policy, meaning
+// -policy is unset) allows mpath through the default -proxy chain.
+func (p *policy) resolve(mpath string) policyDecision {
+	d := policyDecision{client: client, action: "allow"}
+	if p == nil {
+		return d
+	}
+	best := -1
+	for _, r := range p.rules {
+		if !strings.HasPrefix(mpath, r.Prefix) || len(r.Prefix) <= best {
+			continue
+		}
+		best = len(r.Prefix)
+		d.action = r.Action
+		if d.action == "" {
+			d.action = "allow"
+		}
+		d.authToken = r.AuthToken
+		d.ttl = r.TTL
+		d.client = client
+		if up, ok := p.upstreams[r.Upstream]; ok {
+			d.client = up
+		}
+	}
+	return d
+}
+
+// errPolicyDenied is returned when -policy denies mpath outright, or
+// requires auth that the request didn't supply or got wrong. proxy.Server
+// maps any error its ops methods return to a 404, the same face a client
+// sees for a module that simply doesn't exist; that's deliberate, since
+// the module proxy protocol has no room for a 403/401 and "looks like it
+// doesn't exist" is the right thing for a denied module to look like to a
+// client that isn't supposed to know it's there at all.
+var errPolicyDenied = errors.New("goproxy: denied by policy")
+
+// authTokenKey is the context key onlineOps.NewContext stores the
+// request's bearer token under, for checkPolicy to read back out.
+type authTokenKey struct{}
+
+// resolveModule returns mpath's policyDecision, honoring -exclude before
+// -policy: -exclude, the older and simpler of the two mechanisms, takes
+// priority, so a module matching it always goes straight to its VCS via
+// directClient, exactly as it did when the embedded proxy.Router made
+// this decision.
+func resolveModule(mpath string) policyDecision {
+	if excludeHost != "" && proxy.GlobsMatchPath(excludeHost, mpath) {
+		return policyDecision{client: directClient, action: "allow"}
+	}
+	return currentPolicy().resolve(mpath)
+}
+
+// checkPolicy resolves mpath against -exclude and the active -policy and
+// enforces its action, returning errPolicyDenied if mpath is denied or
+// its required auth is missing or wrong.
+func checkPolicy(ctx context.Context, mpath string) (policyDecision, error) {
+	d := resolveModule(mpath)
+	switch d.action {
+	case "deny":
+		return d, errPolicyDenied
+	case "auth":
+		tok, _ := ctx.Value(authTokenKey{}).(string)
+		if tok == "" || !secureTokenEqual(tok, d.authToken) {
+			return d, errPolicyDenied
+		}
+	}
+	return d, nil
+}
+
+// secureTokenEqual reports whether got and want are the same secret token,
+// comparing SHA-256 digests with subtle.ConstantTimeCompare rather than ==
+// so a byte-by-byte timing difference can't leak how much of a guessed
+// token is correct to a remote caller. Used for every bearer-token check
+// in this package, including POST /warmup's (see warmup.go).
+func secureTokenEqual(got, want string) bool {
+	gotSum := sha256.Sum256([]byte(got))
+	wantSum := sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(gotSum[:], wantSum[:]) == 1
+}
+
+// authTokenFromRequest extracts the bearer token from r's Authorization
+// header, for onlineOps.NewContext to stash into the request context.
+func authTokenFromRequest(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storageFlag selects the backend that persists everything this proxy
+// caches: module .info/.mod/.zip/list files, hash sidecars, negative
+// cache sentinels and sumdb lookups. An empty value (the default) uses
+// the local disk under downloadRoot, exactly as before this flag
+// existed. A URL like "s3://bucket/prefix?region=us-east-1" or
+// "gs://bucket/prefix" selects an object storage backend instead, which
+// is what lets multiple goproxy replicas share one cache.
+var storageFlag = flag.String("storage", "", `cache storage backend: empty for local disk, or a URL such as "s3://bucket/prefix?region=us-east-1&endpoint=http://minio:9000" or "gs://bucket/prefix"`)
+
+// store is the Storage backing every cache read/write in this binary.
+// It is built in init, from storageFlag, once downloadRoot is known.
+var store Storage
+
+// A Storage is the persistence layer behind the module cache: where
+// cached .info/.mod/.zip/list files, hash sidecars, negative-cache
+// sentinels and sumdb lookups actually live. Keys are '/'-separated,
+// relative to the backend's root (a local directory, or a bucket+prefix).
+type Storage interface {
+	// Get returns the content stored at key. The returned error
+	// satisfies os.IsNotExist if key doesn't exist.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores data at key, creating any necessary structure.
+	Put(ctx context.Context, key string, data io.Reader) error
+	// Stat returns metadata for key without fetching its content. The
+	// returned error satisfies os.IsNotExist if key doesn't exist.
+	Stat(ctx context.Context, key string) (StorageInfo, error)
+	// List returns every key stored under prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes key. It is not an error if key doesn't exist.
+	Delete(ctx context.Context, key string) error
+}
+
+// StorageInfo is the metadata Storage.Stat returns for a key.
+type StorageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// newStorage builds the Storage named by rawurl, rooted at localRoot
+// when rawurl is empty.
+func newStorage(rawurl, localRoot string) (Storage, error) {
+	if rawurl == "" {
+		return &diskStorage{root: localRoot}, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("-storage %q: %v", rawurl, err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return newS3Storage(u.Host, prefix, u.Query())
+	case "gs":
+		return newGCSStorage(u.Host, prefix)
+	case "file":
+		return &diskStorage{root: filepath.Join(u.Host, u.Path)}, nil
+	default:
+		return nil, fmt.Errorf("-storage %q: unsupported scheme %q, want one of s3, gs, file", rawurl, u.Scheme)
+	}
+}
+
+// errNotExist wraps an underlying backend error so callers can keep
+// using os.IsNotExist against Storage results, regardless of backend.
+type errNotExist struct{ key string }
+
+func (e *errNotExist) Error() string        { return fmt.Sprintf("%s: not found", e.key) }
+func (e *errNotExist) Is(target error) bool { return target == os.ErrNotExist }
+
+// A diskStorage is a Storage backed by the local filesystem rooted at root.
+type diskStorage struct{ root string }
+
+// path resolves key to an absolute filesystem path under s.root, failing
+// closed if key (e.g. via a ".." segment) would otherwise escape root.
+// Every diskStorage method must route through this, not filepath.Join
+// directly, since keys can originate from request paths (see sumdb.go).
+func (s *diskStorage) path(key string) (string, error) {
+	file := filepath.Join(s.root, filepath.FromSlash(key))
+	root, err := filepath.Abs(s.root)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	if abs != root && !strings.HasPrefix(abs, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("storage: key %q escapes storage root", key)
+	}
+	return abs, nil
+}
+
+func (s *diskStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &errNotExist{key: key}
+	}
+	return f, err
+}
+
+func (s *diskStorage) Put(ctx context.Context, key string, data io.Reader) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(filepath.ToSlash(file)), os.ModePerm); err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0666)
+}
+
+func (s *diskStorage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return StorageInfo{}, &errNotExist{key: key}
+	}
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *diskStorage) Delete(ctx context.Context, key string) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *diskStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	root, err := s.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(root); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var keys []string
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// A gcsStorage is a Storage backed by a Google Cloud Storage bucket,
+// selected with e.g. -storage gs://bucket/prefix.
+type gcsStorage struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func newGCSStorage(bucket, prefix string) (Storage, error) {
+	if bucket == "" {
+		return nil, errors.New("-storage gs://...: missing bucket")
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("creating GCS client: %v", err)
+	}
+	return &gcsStorage{bucket: client.Bucket(bucket), prefix: prefix}, nil
+}
+
+func (s *gcsStorage) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *gcsStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(s.key(key)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, &errNotExist{key: key}
+	}
+	return r, err
+}
+
+func (s *gcsStorage) Put(ctx context.Context, key string, data io.Reader) error {
+	w := s.bucket.Object(s.key(key)).NewWriter(ctx)
+	if _, err := io.Copy(w, data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *gcsStorage) Stat(ctx context.Context, key string) (StorageInfo, error) {
+	attrs, err := s.bucket.Object(s.key(key)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return StorageInfo{}, &errNotExist{key: key}
+	}
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+func (s *gcsStorage) Delete(ctx context.Context, key string) error {
+	err := s.bucket.Object(s.key(key)).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return err
+}
+
+func (s *gcsStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.key(prefix)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := attrs.Name
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
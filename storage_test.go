@@ -0,0 +1,77 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStorageRejectsEscapingKeys(t *testing.T) {
+	root, err := ioutil.TempDir("", "goproxy-storage-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	secret := filepath.Join(filepath.Dir(root), "secret")
+	if err := ioutil.WriteFile(secret, []byte("top secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret)
+
+	s := &diskStorage{root: root}
+	ctx := context.Background()
+	escaping := []string{
+		"../secret",
+		"a/../../secret",
+		"../../../../../../../etc/passwd",
+	}
+	for _, key := range escaping {
+		if _, err := s.Get(ctx, key); err == nil {
+			t.Errorf("Get(%q): want error, got nil", key)
+		}
+		if _, err := s.Stat(ctx, key); err == nil {
+			t.Errorf("Stat(%q): want error, got nil", key)
+		}
+		if err := s.Put(ctx, key, bytes.NewReader([]byte("x"))); err == nil {
+			t.Errorf("Put(%q): want error, got nil", key)
+		}
+		if err := s.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q): want error, got nil", key)
+		}
+	}
+}
+
+func TestDiskStorageRoundTrip(t *testing.T) {
+	root, err := ioutil.TempDir("", "goproxy-storage-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := &diskStorage{root: root}
+	ctx := context.Background()
+	key := "example.com/mod/@v/v1.0.0.info"
+	if err := s.Put(ctx, key, bytes.NewReader([]byte(`{"Version":"v1.0.0"}`))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"Version":"v1.0.0"}` {
+		t.Errorf("Get returned %q", data)
+	}
+}
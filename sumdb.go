@@ -0,0 +1,133 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// sumdbFlag lists the checksum databases this proxy will transparently
+// proxy and cache under /sumdb/<name>/. Empty disables sumdb proxying,
+// leaving the embedded proxy.Server/Router's own (non-caching) sumdb
+// handler in charge. Package var initializers run before any init func,
+// so this flag is registered in time for main.go's init to call
+// flag.Parse regardless of file compile order.
+var sumdbFlag = flag.String("sumdb", "sum.golang.org", "comma-separated checksum databases to proxy and cache under /sumdb/<name>/, empty to disable")
+
+// sumdbProxy serves GET /sumdb/<name>/supported, /sumdb/<name>/lookup/...
+// and /sumdb/<name>/tile/... for every name listed in -sumdb, caching
+// responses under downloadRoot/sumdb/<name>/ using the same relative
+// layout the go command itself requests. It is nil when -sumdb is empty.
+var sumdbProxy *sumdbHandler
+
+// initSumdbProxy parses sumdbFlag and builds sumdbProxy. It is called
+// from main.go's init, after flag.Parse.
+func initSumdbProxy() {
+	var names []string
+	for _, name := range strings.Split(*sumdbFlag, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	supported := make(map[string]bool, len(names))
+	for _, name := range names {
+		supported[name] = true
+	}
+	sumdbProxy = &sumdbHandler{
+		supported: supported,
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// A sumdbHandler is an http.Handler implementing the checksum database
+// proxy routes for the names in supported.
+type sumdbHandler struct {
+	supported map[string]bool
+	http      *http.Client
+}
+
+// ServeHTTP implements http.Handler.
+func (h *sumdbHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/sumdb/")
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		http.Error(w, "malformed sumdb request", http.StatusNotFound)
+		return
+	}
+	name, rest := rest[:i], rest[i+1:]
+	if !h.supported[name] {
+		http.Error(w, fmt.Sprintf("unknown checksum database %q", name), http.StatusGone)
+		return
+	}
+	if !safeSumdbPath(rest) {
+		http.Error(w, "malformed sumdb request", http.StatusBadRequest)
+		return
+	}
+	if rest == "supported" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	key := path.Join("sumdb", name, rest)
+	if rc, err := store.Get(r.Context(), key); err == nil {
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err == nil {
+			w.Write(data)
+			return
+		}
+	}
+	if offLine {
+		http.Error(w, "not in offline sumdb cache", http.StatusNotFound)
+		return
+	}
+
+	resp, err := h.http.Get("https://" + name + "/" + rest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+	if err := putCache(r.Context(), key, body); err != nil {
+		log.Printf("sumdb cache write failed for %s: %v", key, err)
+	}
+	w.Write(body)
+}
+
+// safeSumdbPath reports whether rest, the request path remaining after
+// /sumdb/<name>/, is safe to join onto a storage key: no "." or ".."
+// segment, so a request can't escape the name's own subtree (and, via
+// diskStorage, the cache root on disk).
+func safeSumdbPath(rest string) bool {
+	if rest == "" || path.IsAbs(rest) {
+		return false
+	}
+	for _, seg := range strings.Split(rest, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestSafeSumdbPath(t *testing.T) {
+	cases := []struct {
+		rest string
+		want bool
+	}{
+		{"lookup/example.com/mod@v1.0.0", true},
+		{"tile/8/1/2", true},
+		{"supported", true},
+		{"", false},
+		{"..", false},
+		{"../../../../etc/passwd", false},
+		{"lookup/../../../etc/passwd", false},
+		{"./lookup", false},
+		{"/etc/passwd", false},
+	}
+	for _, c := range cases {
+		if got := safeSumdbPath(c.rest); got != c.want {
+			t.Errorf("safeSumdbPath(%q) = %v, want %v", c.rest, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// verifyFlag controls how strictly cached .info/.mod/.zip files are
+// checked against the h1: hash recorded the first time each one was
+// downloaded.
+var verifyFlag = flag.String("verify", "strict", `how strictly to verify cached .info/.mod/.zip files against their recorded h1: hash: "strict" quarantines and re-fetches on mismatch, "warn" only logs a mismatch, "off" skips verification`)
+
+// negativeCacheTTL bounds how long a cached "not found" response for a
+// nonexistent module or version is trusted before asking upstream again.
+var negativeCacheTTL = flag.Duration("negativeCacheTTL", time.Hour, "how long a cached \"not found\" response is trusted before the upstream is asked again")
+
+func verifyMode() string {
+	switch *verifyFlag {
+	case "strict", "warn", "off":
+		return *verifyFlag
+	default:
+		log.Printf("goproxy: unknown -verify mode %q, using strict", *verifyFlag)
+		return "strict"
+	}
+}
+
+// computeHash returns the h1: hash of key, which is the cached name (one
+// of "info", "mod" or "zip") for modPath@version, stored in store. Zip
+// archives are hashed with dirhash.HashZip; the single-file .info and .mod
+// are hashed the same way the go command hashes a lone file, as if it were
+// the only entry of a directory tree.
+func computeHash(ctx context.Context, modPath, version, name, key string) (string, error) {
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	if name == "zip" {
+		return hashZip(data)
+	}
+	open := func(string) (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(data)), nil }
+	return dirhash.Hash1([]string{modPath + "@" + version + "/" + name}, open)
+}
+
+// hashZip runs dirhash.HashZip over data, which only accepts a path on
+// disk rather than raw bytes. Since a Storage backend hands back bytes,
+// not a path, data is spooled to a scratch temp file first.
+func hashZip(data []byte) (string, error) {
+	tmp, err := ioutil.TempFile("", "goproxy-zip-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return dirhash.HashZip(tmp.Name(), dirhash.Hash1)
+}
+
+// recordHash computes key's hash and writes it to its sidecar ".h1" entry,
+// establishing the trusted baseline for future verifyCached calls.
+func recordHash(ctx context.Context, modPath, version, name, key string) error {
+	h, err := computeHash(ctx, modPath, version, name, key)
+	if err != nil {
+		return err
+	}
+	return putCache(ctx, key+".h1", []byte(h))
+}
+
+// verifyCached checks an already-cached key against its recorded h1:
+// hash, as controlled by -verify. It returns nil when key is safe to
+// serve as-is. A non-nil return means the caller should treat key as a
+// cache miss and re-fetch it: either it's the first time this key has
+// been seen (no baseline hash recorded yet, so one is recorded now), or
+// -verify=strict found a mismatch and quarantined the corrupt entry.
+func verifyCached(ctx context.Context, modPath, version, name, key string) error {
+	if verifyMode() == "off" {
+		return nil
+	}
+	sidecar := key + ".h1"
+	rc, err := store.Get(ctx, sidecar)
+	if err != nil {
+		return recordHash(ctx, modPath, version, name, key)
+	}
+	want, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	got, err := computeHash(ctx, modPath, version, name, key)
+	if err != nil {
+		return err
+	}
+	if got == string(want) {
+		return nil
+	}
+	log.Printf("goproxy: %s@%s %s: hash mismatch, want %s got %s", modPath, version, name, want, got)
+	if verifyMode() == "warn" {
+		return nil
+	}
+	if err := quarantine(ctx, key); err != nil {
+		log.Printf("goproxy: quarantining %s failed: %v", key, err)
+	}
+	store.Delete(ctx, sidecar)
+	return fmt.Errorf("%s@%s %s: hash mismatch, re-fetching", modPath, version, name)
+}
+
+// quarantine moves key aside under a "corrupt/" prefix instead of deleting
+// it outright, so operators can inspect what was corrupted instead of it
+// silently disappearing.
+func quarantine(ctx context.Context, key string) error {
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	dest := path.Join("corrupt", fmt.Sprintf("%s.%d", key, time.Now().UnixNano()))
+	if err := putCache(ctx, dest, data); err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// notFoundSentinel returns the negative-cache sentinel key for key,
+// e.g. ".../@v/list" -> ".../@v/list.notfound".
+func notFoundSentinel(key string) string { return key + ".notfound" }
+
+// checkNotFoundCache returns os.ErrNotExist if key has an unexpired
+// negative-cache sentinel, so repeated requests for a module or version
+// that doesn't exist don't stampede the upstream every time.
+func checkNotFoundCache(ctx context.Context, key string) error {
+	sentinel := notFoundSentinel(key)
+	info, err := store.Stat(ctx, sentinel)
+	if err != nil {
+		return nil
+	}
+	if time.Since(info.ModTime) >= *negativeCacheTTL {
+		store.Delete(ctx, sentinel)
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+// recordNotFound writes (or refreshes) the negative-cache sentinel for key.
+func recordNotFound(ctx context.Context, key string) {
+	if err := putCache(ctx, notFoundSentinel(key), nil); err != nil {
+		log.Printf("goproxy: recording not-found cache for %s failed: %v", key, err)
+	}
+}
+
+// logDeprecation looks up mpath's deprecation notice and the retraction
+// status of its latest version via "go list -m -json -retracted", and
+// logs whatever it finds so operators can see it without digging through
+// go.mod retract directives themselves. go list -m -versions already
+// omits retracted versions from @v/list by default, so nothing else
+// needs to change there.
+func logDeprecation(mpath string) {
+	var info struct {
+		Version    string
+		Deprecated string
+		Retracted  []string
+	}
+	if err := goJSON(&info, "go", "list", "-m", "-json", "-retracted", mpath+"@latest"); err != nil {
+		return
+	}
+	if info.Deprecated != "" {
+		log.Printf("goproxy: module %s is deprecated: %s", mpath, info.Deprecated)
+	}
+	if len(info.Retracted) > 0 {
+		log.Printf("goproxy: %s@%s is retracted: %s", mpath, info.Version, strings.Join(info.Retracted, "; "))
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// withTestStore points the package-global store at a fresh diskStorage
+// rooted in a t.TempDir, restoring the previous store on test cleanup, so
+// tests can exercise verify.go/client.go's caching helpers without
+// touching a real cache directory.
+func withTestStore(t *testing.T) {
+	t.Helper()
+	prev := store
+	store = &diskStorage{root: t.TempDir()}
+	t.Cleanup(func() { store = prev })
+}
+
+func TestVerifyCachedRecordsBaselineOnFirstSeen(t *testing.T) {
+	withTestStore(t)
+	ctx := context.Background()
+	key := "example.com/mod/@v/v1.0.0.info"
+	if err := putCache(ctx, key, []byte(`{"Version":"v1.0.0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCached(ctx, "example.com/mod", "v1.0.0", "info", key); err != nil {
+		t.Fatalf("verifyCached on first sighting = %v, want nil (baseline recorded)", err)
+	}
+	if _, err := store.Get(ctx, key+".h1"); err != nil {
+		t.Fatalf("recordHash did not write a sidecar: %v", err)
+	}
+	// Now that a baseline exists, an unchanged file must still verify clean.
+	if err := verifyCached(ctx, "example.com/mod", "v1.0.0", "info", key); err != nil {
+		t.Errorf("verifyCached against its own recorded hash = %v, want nil", err)
+	}
+}
+
+func TestVerifyCachedQuarantinesOnMismatch(t *testing.T) {
+	*verifyFlag = "strict"
+	withTestStore(t)
+	ctx := context.Background()
+	key := "example.com/mod/@v/v1.0.0.info"
+	if err := putCache(ctx, key, []byte(`{"Version":"v1.0.0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCached(ctx, "example.com/mod", "v1.0.0", "info", key); err != nil {
+		t.Fatalf("recording baseline: %v", err)
+	}
+	// Corrupt the cached entry without updating its recorded hash.
+	if err := putCache(ctx, key, []byte(`{"Version":"tampered"}`)); err != nil {
+		t.Fatal(err)
+	}
+	err := verifyCached(ctx, "example.com/mod", "v1.0.0", "info", key)
+	if err == nil {
+		t.Fatal("verifyCached on a tampered entry = nil, want a re-fetch error")
+	}
+	if _, statErr := store.Stat(ctx, key); statErr == nil {
+		t.Error("tampered entry still present at key, want it removed by quarantine")
+	}
+	entries, err := store.List(ctx, "corrupt/")
+	if err != nil {
+		t.Fatalf("listing corrupt/: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("corrupt/ entries = %d, want 1", len(entries))
+	}
+	rc, err := store.Get(ctx, entries[0])
+	if err != nil {
+		t.Fatalf("reading quarantined copy: %v", err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("tampered")) {
+		t.Errorf("quarantined copy = %q, want the tampered content preserved", data)
+	}
+}
+
+func TestVerifyCachedWarnModeKeepsCorruptEntry(t *testing.T) {
+	*verifyFlag = "warn"
+	t.Cleanup(func() { *verifyFlag = "strict" })
+	withTestStore(t)
+	ctx := context.Background()
+	key := "example.com/mod/@v/v1.0.0.info"
+	if err := putCache(ctx, key, []byte(`{"Version":"v1.0.0"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCached(ctx, "example.com/mod", "v1.0.0", "info", key); err != nil {
+		t.Fatalf("recording baseline: %v", err)
+	}
+	if err := putCache(ctx, key, []byte(`{"Version":"tampered"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyCached(ctx, "example.com/mod", "v1.0.0", "info", key); err != nil {
+		t.Errorf("verifyCached in warn mode = %v, want nil (mismatch only logged)", err)
+	}
+	if _, err := store.Stat(ctx, key); err != nil {
+		t.Errorf("warn mode must not quarantine: entry missing: %v", err)
+	}
+}
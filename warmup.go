@@ -0,0 +1,271 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/goproxyio/goproxy/v2/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/mod/module"
+	"golang.org/x/sync/singleflight"
+)
+
+// warmupFlag names a file of "module version" seed lines to pre-download
+// (along with their transitive build list) before serving traffic.
+var warmupFlag = flag.String("warmup", "", "file of \"module version\" seed lines to prefetch into the cache on startup")
+
+// warmupConcurrency bounds how many module versions are downloaded at once
+// by a single warmup run, whether triggered by -warmup or POST /warmup.
+var warmupConcurrency = flag.Int("warmupConcurrency", 8, "maximum concurrent downloads during a warmup run")
+
+// warmupTokenFlag, when set, is the bearer token POST /warmup requires in
+// its Authorization header - the same scheme -policy's "auth" action
+// checks via authTokenFromRequest, just keyed to this one admin endpoint
+// rather than a module path prefix. Left empty (the default), /warmup is
+// unauthenticated; operators exposing it on anything but a trusted
+// loopback/internal listener should set this.
+var warmupTokenFlag = flag.String("warmupToken", "", "if set, the bearer token required in the Authorization header to call POST /warmup")
+
+// warmupMaxBody bounds the size of a POST /warmup request body, so a
+// client can't force an unbounded read into memory with an oversized or
+// unterminated body.
+const warmupMaxBody = 1 << 20 // 1MiB
+
+var (
+	warmupModulesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_warmup_modules_total",
+		Help: "Module versions processed by warmup runs, by result.",
+	}, []string{"result"})
+	warmupBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "goproxy_warmup_bytes_total",
+		Help: "Bytes of .info/.mod/.zip files downloaded by warmup runs.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(warmupModulesTotal, warmupBytesTotal)
+}
+
+// warmupGroup deduplicates concurrent downloads of the same module
+// version, whether they come from the same warmup run or overlapping
+// runs.
+var warmupGroup singleflight.Group
+
+// runWarmup resolves the transitive build list of each seed with
+// "go list -m -json all" run in an isolated, disposable GOPATH, then
+// downloads every module version's .info, .mod and .zip into
+// downloadRoot using the shared proxyClient, with at most
+// *warmupConcurrency downloads in flight at a time.
+func runWarmup(seeds []module.Version) {
+	sem := make(chan struct{}, *warmupConcurrency)
+	var wg sync.WaitGroup
+	seen := map[string]bool{}
+	var mu sync.Mutex
+
+	warm := func(m module.Version) {
+		key := m.String()
+		mu.Lock()
+		if seen[key] {
+			mu.Unlock()
+			return
+		}
+		seen[key] = true
+		mu.Unlock()
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			warmupOne(m)
+		}()
+	}
+
+	for _, seed := range seeds {
+		log.Printf("warmup: resolving build list for %s\n", seed)
+		list, err := resolveBuildList(seed)
+		if err != nil {
+			log.Printf("warmup: resolving %s failed: %v\n", seed, err)
+			warmupModulesTotal.With(prometheus.Labels{"result": "error"}).Inc()
+			continue
+		}
+		warm(seed)
+		for _, m := range list {
+			warm(m)
+		}
+	}
+	wg.Wait()
+}
+
+// warmupOne downloads a single module version's .info, .mod and .zip,
+// deduplicating concurrent requests for the same version via warmupGroup.
+// It honors -policy routing the same way a live request would, so warming
+// up a module routed to a private upstream doesn't wrongly fetch it from
+// the default -proxy chain.
+func warmupOne(m module.Version) {
+	v, err, shared := warmupGroup.Do(m.String(), func() (interface{}, error) {
+		ctx := context.Background()
+		d := resolveModule(m.Path)
+		if d.action == "deny" {
+			return nil, errPolicyDenied
+		}
+		var size int64
+		for _, fetch := range []func(context.Context, module.Version) (proxy.File, error){d.client.Info, d.client.GoMod, d.client.Zip} {
+			f, err := fetch(ctx, m)
+			if err != nil {
+				return nil, err
+			}
+			if info, err := f.Stat(); err == nil {
+				size += info.Size()
+			}
+			f.Close()
+		}
+		return size, nil
+	})
+	if err != nil {
+		log.Printf("warmup: %s: %v\n", m, err)
+		warmupModulesTotal.With(prometheus.Labels{"result": "miss"}).Inc()
+		return
+	}
+	if !shared {
+		warmupBytesTotal.Add(float64(v.(int64)))
+	}
+	warmupModulesTotal.With(prometheus.Labels{"result": "hit"}).Inc()
+}
+
+// resolveBuildList runs "go mod init" + "go get <seed>" + "go list -m
+// -json all" in a throwaway module directory, returning every
+// non-main module version in the resulting build list.
+func resolveBuildList(seed module.Version) ([]module.Version, error) {
+	dir, err := os.MkdirTemp("", "goproxy-warmup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	run := func(args ...string) error {
+		cmd := exec.Command("go", args...)
+		cmd.Dir = dir
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("go %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+		}
+		return nil
+	}
+	if err := run("mod", "init", "goproxy-warmup"); err != nil {
+		return nil, err
+	}
+	if err := run("get", seed.String()); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("go", "list", "-m", "-json", "all")
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list -m -json all: %v: %s", err, stderr.String())
+	}
+
+	dec := json.NewDecoder(&stdout)
+	var list []module.Version
+	for {
+		var m struct {
+			Path    string
+			Version string
+			Main    bool
+		}
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if m.Main || m.Version == "" {
+			continue
+		}
+		list = append(list, module.Version{Path: m.Path, Version: m.Version})
+	}
+	return list, nil
+}
+
+// loadWarmupSeeds reads "module version" lines from file, skipping blank
+// lines and lines starting with '#'.
+func loadWarmupSeeds(file string) ([]module.Version, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var seeds []module.Version
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: malformed line %q, want \"module version\"", file, line)
+		}
+		seeds = append(seeds, module.Version{Path: fields[0], Version: fields[1]})
+	}
+	return seeds, scanner.Err()
+}
+
+// warmupHandler implements POST /warmup, the admin endpoint that
+// triggers a warmup run for a set of seed modules without restarting
+// the server.
+type warmupHandler struct{}
+
+// warmupRequest is one element of the POST /warmup JSON body.
+type warmupRequest struct {
+	Module  string `json:"module"`
+	Version string `json:"version"`
+}
+
+func (warmupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if *warmupTokenFlag != "" && !secureTokenEqual(authTokenFromRequest(r), *warmupTokenFlag) {
+		http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, warmupMaxBody)
+	var reqs []warmupRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seeds := make([]module.Version, 0, len(reqs))
+	for _, req := range reqs {
+		if req.Module == "" || req.Version == "" {
+			http.Error(w, "module and version are required", http.StatusBadRequest)
+			return
+		}
+		seeds = append(seeds, module.Version{Path: req.Module, Version: req.Version})
+	}
+	go runWarmup(seeds)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "warming up %d seed module(s)\n", len(seeds))
+}
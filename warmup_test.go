@@ -0,0 +1,70 @@
+// Copyright 2019 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWarmupHandlerRequiresConfiguredToken(t *testing.T) {
+	prev := *warmupTokenFlag
+	*warmupTokenFlag = "s3cr3t"
+	t.Cleanup(func() { *warmupTokenFlag = prev })
+
+	body := `[{"module":"example.com/mod","version":"v1.0.0"}]`
+
+	req := httptest.NewRequest(http.MethodPost, "/warmup", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	warmupHandler{}.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no Authorization header: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/warmup", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	warmupHandler{}.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong bearer token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/warmup", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	w = httptest.NewRecorder()
+	warmupHandler{}.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("correct bearer token: status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+}
+
+func TestWarmupHandlerUnauthenticatedWhenTokenUnset(t *testing.T) {
+	prev := *warmupTokenFlag
+	*warmupTokenFlag = ""
+	t.Cleanup(func() { *warmupTokenFlag = prev })
+
+	req := httptest.NewRequest(http.MethodPost, "/warmup", strings.NewReader(`[]`))
+	w := httptest.NewRecorder()
+	warmupHandler{}.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+}
+
+func TestWarmupHandlerRejectsOversizedBody(t *testing.T) {
+	prev := *warmupTokenFlag
+	*warmupTokenFlag = ""
+	t.Cleanup(func() { *warmupTokenFlag = prev })
+
+	huge := `[{"module":"` + strings.Repeat("a", warmupMaxBody) + `","version":"v1.0.0"}]`
+	req := httptest.NewRequest(http.MethodPost, "/warmup", strings.NewReader(huge))
+	w := httptest.NewRecorder()
+	warmupHandler{}.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("oversized body: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}